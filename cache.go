@@ -0,0 +1,192 @@
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+// defaultCacheSize is the number of cached responses kept when Config.CacheSize
+// is unset or non-positive.
+const defaultCacheSize = 10000
+
+// cacheKey identifies a cached response by question plus whether the query
+// requested DNSSEC records via the EDNS DO bit. The same name/type/class can
+// get a different answer depending on that bit (RRSIGs and other DNSSEC
+// records present or stripped), so it must be part of the key or a DO and a
+// non-DO client can be served each other's cached response.
+type cacheKey struct {
+	question dns.Question
+	dnssecOK bool
+}
+
+// cacheKeyFor builds the cacheKey for a query, reading the DO bit off its
+// EDNS OPT pseudo-RR if present.
+func cacheKeyFor(msg *dns.Msg) cacheKey {
+	dnssecOK := false
+	if opt := msg.IsEdns0(); opt != nil {
+		dnssecOK = opt.Do()
+	}
+	return cacheKey{question: msg.Question[0], dnssecOK: dnssecOK}
+}
+
+// DNSCache caches parsed DNS responses keyed by question name/type/class (and
+// whether DNSSEC was requested) and serves them with RR TTLs adjusted for
+// elapsed time. Implementations must be safe for concurrent use, since
+// handleDoHRequest and handleDoTConnection both call through processDNSQuery.
+type DNSCache interface {
+	// Get returns a copy of the cached response for key with every RR's TTL
+	// decremented by the time elapsed since insertion. ok is false on a
+	// miss or once the entry's cached lifetime has elapsed, in which case
+	// the caller should refetch.
+	Get(key cacheKey) (resp *dns.Msg, ok bool)
+	// Set inserts resp under key, expiring it after ttl.
+	Set(key cacheKey, resp *dns.Msg, ttl time.Duration)
+}
+
+// cacheEntry is the value stored in memoryCache's LRU list.
+type cacheEntry struct {
+	key        cacheKey
+	msg        *dns.Msg
+	insertedAt time.Time
+	ttl        time.Duration
+}
+
+// memoryCache is an in-memory, LRU-evicted DNSCache.
+type memoryCache struct {
+	mu         sync.Mutex
+	ll         *list.List
+	entries    map[cacheKey]*list.Element
+	maxEntries int
+	minTTL     time.Duration
+	maxTTL     time.Duration
+}
+
+// newMemoryCache creates a DNSCache holding at most maxEntries responses
+// (defaulting to defaultCacheSize when maxEntries <= 0). Every inserted TTL is
+// clamped to minTTL, and to maxTTL when maxTTL > 0.
+func newMemoryCache(maxEntries int, minTTL, maxTTL time.Duration) *memoryCache {
+	if maxEntries <= 0 {
+		maxEntries = defaultCacheSize
+	}
+	return &memoryCache{
+		ll:         list.New(),
+		entries:    make(map[cacheKey]*list.Element),
+		maxEntries: maxEntries,
+		minTTL:     minTTL,
+		maxTTL:     maxTTL,
+	}
+}
+
+func (c *memoryCache) Get(key cacheKey) (*dns.Msg, bool) {
+	c.mu.Lock()
+	el, ok := c.entries[key]
+	if !ok {
+		c.mu.Unlock()
+		return nil, false
+	}
+
+	entry := el.Value.(*cacheEntry)
+	elapsed := time.Since(entry.insertedAt)
+	if elapsed >= entry.ttl {
+		c.ll.Remove(el)
+		delete(c.entries, key)
+		c.mu.Unlock()
+		return nil, false
+	}
+
+	c.ll.MoveToFront(el)
+	resp := entry.msg.Copy()
+	c.mu.Unlock()
+
+	age := uint32(elapsed / time.Second)
+	ageRRs(resp.Answer, age)
+	ageRRs(resp.Ns, age)
+	ageRRs(resp.Extra, age)
+
+	return resp, true
+}
+
+func (c *memoryCache) Set(key cacheKey, resp *dns.Msg, ttl time.Duration) {
+	if ttl < c.minTTL {
+		ttl = c.minTTL
+	}
+	if c.maxTTL > 0 && ttl > c.maxTTL {
+		ttl = c.maxTTL
+	}
+
+	entry := &cacheEntry{key: key, msg: resp.Copy(), insertedAt: time.Now(), ttl: ttl}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.entries[key]; ok {
+		c.ll.Remove(el)
+	}
+	c.entries[key] = c.ll.PushFront(entry)
+
+	for c.ll.Len() > c.maxEntries {
+		oldest := c.ll.Back()
+		if oldest == nil {
+			break
+		}
+		c.ll.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// ageRRs decrements each RR's TTL by ageSeconds, clamping at zero. OPT
+// pseudo-RRs are skipped: their "TTL" field encodes EDNS extended-RCODE,
+// version and flags, not a cache lifetime.
+func ageRRs(rrs []dns.RR, ageSeconds uint32) {
+	for _, rr := range rrs {
+		if rr.Header().Rrtype == dns.TypeOPT {
+			continue
+		}
+		hdr := rr.Header()
+		if hdr.Ttl <= ageSeconds {
+			hdr.Ttl = 0
+		} else {
+			hdr.Ttl -= ageSeconds
+		}
+	}
+}
+
+// responseTTL computes how long resp should be cached for: the SOA MINIMUM
+// per RFC 2308 for negative (NXDOMAIN/NODATA) responses, or the minimum RR
+// TTL across the answer, authority and additional sections otherwise. The
+// EDNS OPT pseudo-RR (if present in Extra) is ignored, since its "TTL" field
+// isn't a cache lifetime.
+func responseTTL(resp *dns.Msg) time.Duration {
+	negative := resp.Rcode == dns.RcodeNameError ||
+		(resp.Rcode == dns.RcodeSuccess && len(resp.Answer) == 0)
+
+	if negative {
+		for _, rr := range resp.Ns {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return time.Duration(soa.Minimum) * time.Second
+			}
+		}
+		return 0
+	}
+
+	var min uint32
+	have := false
+	for _, rrs := range [][]dns.RR{resp.Answer, resp.Ns, resp.Extra} {
+		for _, rr := range rrs {
+			if rr.Header().Rrtype == dns.TypeOPT {
+				continue
+			}
+			if ttl := rr.Header().Ttl; !have || ttl < min {
+				min = ttl
+				have = true
+			}
+		}
+	}
+	if !have {
+		return 0
+	}
+	return time.Duration(min) * time.Second
+}
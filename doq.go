@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"io"
+	"log"
+
+	"github.com/quic-go/quic-go"
+	"golang.org/x/time/rate"
+)
+
+// startDoQServer starts a DNS-over-QUIC (RFC 9250) server on :853/udp,
+// sharing the same Let's Encrypt certificate and rate limiter as the DoT
+// listener on :853/tcp.
+func startDoQServer(limiter *rate.Limiter) {
+	cer, err := loadServerCertificate()
+	if err != nil {
+		log.Fatal(err)
+	}
+	tlsConfig := &tls.Config{
+		Certificates: []tls.Certificate{cer},
+		NextProtos:   []string{"doq"},
+	}
+
+	listener, err := quic.ListenAddr(":853", tlsConfig, &quic.Config{})
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer listener.Close()
+
+	for {
+		conn, err := listener.Accept(context.Background())
+		if err != nil {
+			log.Println(err)
+			continue
+		}
+		go handleDoQConnection(conn, limiter)
+	}
+}
+
+// handleDoQConnection serves every bidirectional stream opened on a DoQ
+// session, each carrying one length-prefixed DNS query and response as
+// required by RFC 9250.
+func handleDoQConnection(conn quic.Connection, limiter *rate.Limiter) {
+	for {
+		stream, err := conn.AcceptStream(context.Background())
+		if err != nil {
+			return
+		}
+		go handleDoQStream(stream, limiter)
+	}
+}
+
+func handleDoQStream(stream quic.Stream, limiter *rate.Limiter) {
+	defer stream.Close()
+
+	if !limiter.Allow() {
+		return
+	}
+
+	lengthBuf := make([]byte, 2)
+	if _, err := io.ReadFull(stream, lengthBuf); err != nil {
+		log.Println(err)
+		return
+	}
+	queryLength := binary.BigEndian.Uint16(lengthBuf)
+
+	query := make([]byte, queryLength)
+	if _, err := io.ReadFull(stream, query); err != nil {
+		log.Println(err)
+		return
+	}
+
+	response, err := processDNSQuery(query)
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	responseLength := make([]byte, 2)
+	binary.BigEndian.PutUint16(responseLength, uint16(len(response)))
+
+	if _, err := stream.Write(responseLength); err != nil {
+		log.Println(err)
+		return
+	}
+	if _, err := stream.Write(response); err != nil {
+		log.Println(err)
+		return
+	}
+}
@@ -22,10 +22,24 @@ var config *Config
 
 // Config represents the structure of the configuration file.
 type Config struct {
-	Host    string            `json:"host"`
-	Domains map[string]string `json:"domains"`
+	Host                string            `json:"host"`
+	Domains             map[string]string `json:"domains"`
+	UpstreamProxy       string            `json:"upstream_proxy"`
+	CacheSize           int               `json:"cache_size"`
+	MinTTL              int               `json:"min_ttl"`
+	MaxTTL              int               `json:"max_ttl"`
+	Upstreams           []UpstreamConfig  `json:"upstreams"`
+	UpstreamStrategy    string            `json:"upstream_strategy"`
+	HealthWindowSeconds int               `json:"health_window_seconds"`
+	AcceptProxyProtocol bool              `json:"accept_proxy_protocol"`
 }
 
+// dnsCache caches upstream and static responses between processDNSQuery calls.
+var dnsCache DNSCache
+
+// upstreamPool resolves queries that don't match config.Domains.
+var upstreamPool *UpstreamPool
+
 // LoadConfig loads the configuration from a JSON file.
 func LoadConfig(filename string) (*Config, error) {
 	var config Config
@@ -46,8 +60,25 @@ func findValueByKeyContains(m map[string]string, substr string) (string, bool) {
 	return "", false // Return empty string and false if no key contains the substring
 }
 
+// sniDispatchLabel maps an SNI hostname to a Prometheus label value bounded
+// to the finite set of configured domain keys, falling back to "other".
+// targetHost comes straight from the client's ClientHello and must never be
+// used as a label value directly: an attacker sending arbitrary SNIs would
+// otherwise create unbounded time series in the /metrics registry.
+func sniDispatchLabel(targetHost string) string {
+	for key := range config.Domains {
+		if strings.Contains(targetHost, strings.ToLower(key)) {
+			return key
+		}
+	}
+	return "other"
+}
+
 // processDNSQuery processes the DNS query and returns a response.
 func processDNSQuery(query []byte) ([]byte, error) {
+	start := time.Now()
+	defer func() { dnsQueryDuration.Observe(time.Since(start).Seconds()) }()
+
 	var msg dns.Msg
 	err := msg.Unpack(query)
 	if err != nil {
@@ -58,7 +89,17 @@ func processDNSQuery(query []byte) ([]byte, error) {
 		return nil, fmt.Errorf("no DNS question found in the request")
 	}
 
-	domain := msg.Question[0].Name
+	question := msg.Question[0]
+	key := cacheKeyFor(&msg)
+	if dnsCache != nil {
+		if cached, ok := dnsCache.Get(key); ok {
+			cached.Id = msg.Id
+			lastResolveSuccess.Store(time.Now().Unix())
+			return cached.Pack()
+		}
+	}
+
+	domain := question.Name
 	if ip, ok := findValueByKeyContains(config.Domains, domain); ok {
 		rr, err := dns.NewRR(domain + " A " + ip)
 		if err != nil {
@@ -66,14 +107,25 @@ func processDNSQuery(query []byte) ([]byte, error) {
 		}
 		msg.Answer = append(msg.Answer, rr)
 	} else {
-		resp, err := http.Post("https://1.1.1.1/dns-query", "application/dns-message", bytes.NewReader(query))
+		respBytes, err := upstreamPool.Resolve(query)
 		if err != nil {
 			return nil, err
 		}
-		defer resp.Body.Close()
-		return io.ReadAll(resp.Body)
+		lastResolveSuccess.Store(time.Now().Unix())
+
+		var respMsg dns.Msg
+		if dnsCache != nil && respMsg.Unpack(respBytes) == nil {
+			dnsCache.Set(key, &respMsg, responseTTL(&respMsg))
+		}
+
+		return respBytes, nil
 	}
 
+	if dnsCache != nil {
+		dnsCache.Set(key, &msg, responseTTL(&msg))
+	}
+
+	lastResolveSuccess.Store(time.Now().Unix())
 	return msg.Pack()
 }
 
@@ -81,22 +133,27 @@ func processDNSQuery(query []byte) ([]byte, error) {
 func handleDoHRequest(limiter *rate.Limiter) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		if !limiter.Allow() {
+			rateLimiterRejectionsTotal.WithLabelValues("doh").Inc()
+			requestsTotal.WithLabelValues("doh", "ratelimited").Inc()
 			http.Error(w, "Rate limit exceeded", http.StatusTooManyRequests)
 			return
 		}
 
 		body, err := io.ReadAll(r.Body)
 		if err != nil {
+			requestsTotal.WithLabelValues("doh", "parse_error").Inc()
 			http.Error(w, "Failed to read request body", http.StatusInternalServerError)
 			return
 		}
 
 		dnsResponse, err := processDNSQuery(body)
 		if err != nil {
+			requestsTotal.WithLabelValues("doh", "upstream_error").Inc()
 			http.Error(w, "Failed to pack DNS response", http.StatusInternalServerError)
 			return
 		}
 
+		requestsTotal.WithLabelValues("doh", "ok").Inc()
 		w.Header().Set("Content-Type", "application/dns-message")
 		w.Write(dnsResponse)
 	}
@@ -108,6 +165,8 @@ func handleDoTConnection(conn net.Conn, limiter *rate.Limiter) {
 
 	if !limiter.Allow() {
 		// Log rate limit exceeded
+		rateLimiterRejectionsTotal.WithLabelValues("dot").Inc()
+		requestsTotal.WithLabelValues("dot", "ratelimited").Inc()
 		return
 	}
 
@@ -116,6 +175,7 @@ func handleDoTConnection(conn net.Conn, limiter *rate.Limiter) {
 	_, err := io.ReadFull(conn, lengthBuf)
 	if err != nil {
 		log.Println(err)
+		requestsTotal.WithLabelValues("dot", "parse_error").Inc()
 		return
 	}
 
@@ -127,6 +187,7 @@ func handleDoTConnection(conn net.Conn, limiter *rate.Limiter) {
 	_, err = io.ReadFull(conn, buffer)
 	if err != nil {
 		log.Println(err)
+		requestsTotal.WithLabelValues("dot", "parse_error").Inc()
 		return
 	}
 
@@ -134,6 +195,7 @@ func handleDoTConnection(conn net.Conn, limiter *rate.Limiter) {
 	response, err := processDNSQuery(buffer) // Process the full message
 	if err != nil {
 		log.Println(err)
+		requestsTotal.WithLabelValues("dot", "upstream_error").Inc()
 		return
 	}
 
@@ -153,13 +215,20 @@ func handleDoTConnection(conn net.Conn, limiter *rate.Limiter) {
 		log.Println(err)
 		return
 	}
+
+	requestsTotal.WithLabelValues("dot", "ok").Inc()
+}
+
+// loadServerCertificate loads the Let's Encrypt certificate for config.Host,
+// shared by the DoT and DoQ listeners.
+func loadServerCertificate() (tls.Certificate, error) {
+	certPrefix := "/etc/letsencrypt/live/" + config.Host + "/"
+	return tls.LoadX509KeyPair(certPrefix+"/fullchain.pem", certPrefix+"privkey.pem")
 }
 
 // startDoTServer starts the DNS-over-TLS server.
 func startDoTServer(limiter *rate.Limiter) {
-	// Load TLS credentials
-	certPrefix := "/etc/letsencrypt/live/" + config.Host + "/"
-	cer, err := tls.LoadX509KeyPair(certPrefix+"/fullchain.pem", certPrefix+"privkey.pem")
+	cer, err := loadServerCertificate()
 	if err != nil {
 		log.Fatal(err)
 	}
@@ -252,6 +321,8 @@ func readClientHello(reader io.Reader) (*tls.ClientHelloInfo, error) {
 }
 
 func handleConnection(clientConn net.Conn) {
+	activeConnections.Inc()
+	defer activeConnections.Dec()
 	defer clientConn.Close()
 
 	if err := clientConn.SetReadDeadline(time.Now().Add(5 * time.Second)); err != nil {
@@ -259,9 +330,27 @@ func handleConnection(clientConn net.Conn) {
 		return
 	}
 
+	if config.AcceptProxyProtocol {
+		wrapped, err := wrapProxyProtocol(clientConn)
+		if err != nil {
+			log.Print(err)
+			requestsTotal.WithLabelValues("sni", "parse_error").Inc()
+			return
+		}
+		clientConn = wrapped
+	}
+
+	clientIP := clientIPOf(clientConn.RemoteAddr())
+	if !sniLimiterFor(clientIP).Allow() {
+		rateLimiterRejectionsTotal.WithLabelValues("sni").Inc()
+		requestsTotal.WithLabelValues("sni", "ratelimited").Inc()
+		return
+	}
+
 	clientHello, clientHelloBytes, err := peekClientHello(clientConn)
 	if err != nil {
-		log.Print(err)
+		log.Printf("%s: %v", clientIP, err)
+		requestsTotal.WithLabelValues("sni", "parse_error").Inc()
 		return
 	}
 
@@ -271,6 +360,7 @@ func handleConnection(clientConn net.Conn) {
 	}
 
 	targetHost := strings.ToLower(clientHello.ServerName)
+	sniDispatchTotal.WithLabelValues(sniDispatchLabel(targetHost)).Inc()
 
 	if targetHost == config.Host {
 		targetHost = net.JoinHostPort(targetHost, "8443")
@@ -278,29 +368,33 @@ func handleConnection(clientConn net.Conn) {
 		targetHost = net.JoinHostPort(targetHost, "443")
 	}
 
-	backendConn, err := net.DialTimeout("tcp", targetHost, 5*time.Second)
+	dialStart := time.Now()
+	backendConn, err := dialUpstream("tcp", targetHost, 5*time.Second)
 	if err != nil {
 		log.Print(err)
+		requestsTotal.WithLabelValues("sni", "upstream_error").Inc()
 		return
 	}
 	defer backendConn.Close()
+	defer func() { sniBackendDuration.Observe(time.Since(dialStart).Seconds()) }()
 
 	var wg sync.WaitGroup
 	wg.Add(2)
 
 	go func() {
 		io.Copy(clientConn, backendConn)
-		clientConn.(*net.TCPConn).CloseWrite()
+		closeWrite(clientConn)
 		wg.Done()
 	}()
 	go func() {
 		io.Copy(backendConn, clientHelloBytes)
 		io.Copy(backendConn, clientConn)
-		backendConn.(*net.TCPConn).CloseWrite()
+		closeWrite(backendConn)
 		wg.Done()
 	}()
 
 	wg.Wait()
+	requestsTotal.WithLabelValues("sni", "ok").Inc()
 }
 
 func runDOHServer(limiter *rate.Limiter) {
@@ -327,10 +421,22 @@ func main() {
 	}
 	config = cfg
 
+	if err := setupUpstreamDialer(cfg); err != nil {
+		log.Fatalf("Failed to configure upstream_proxy: %v", err)
+	}
+
+	dnsCache = newMemoryCache(cfg.CacheSize, time.Duration(cfg.MinTTL)*time.Second, time.Duration(cfg.MaxTTL)*time.Second)
+	upstreamPool = newUpstreamPool(cfg)
+
+	if cfg.HealthWindowSeconds > 0 {
+		healthWindow = time.Duration(cfg.HealthWindowSeconds) * time.Second
+	}
+	lastResolveSuccess.Store(time.Now().Unix())
+
 	log.Println("Starting SSNI proxy server on :443, :853...")
 
 	var wg sync.WaitGroup
-	wg.Add(3)
+	wg.Add(5)
 
 	limiter := rate.NewLimiter(10, 50) // 1 request per second with a burst size of 5
 
@@ -342,10 +448,18 @@ func main() {
 		startDoTServer(limiter)
 		wg.Done()
 	}()
+	go func() {
+		startDoQServer(limiter)
+		wg.Done()
+	}()
 	go func() {
 		serveSniProxy()
 		wg.Done()
 	}()
+	go func() {
+		startMetricsServer()
+		wg.Done()
+	}()
 
 	wg.Wait()
 }
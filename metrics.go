@@ -0,0 +1,110 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// defaultHealthWindow is how recently a query must have resolved successfully
+// for /healthz to report healthy when Config.HealthWindowSeconds is unset.
+const defaultHealthWindow = 2 * time.Minute
+
+var (
+	requestsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "smartsni_requests_total",
+			Help: "Total requests handled, labeled by transport and result.",
+		},
+		[]string{"transport", "result"},
+	)
+
+	sniDispatchTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "smartsni_sni_dispatch_total",
+			Help: "Total SNI proxy connections dispatched, labeled by target domain.",
+		},
+		[]string{"domain"},
+	)
+
+	rateLimiterRejectionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "smartsni_ratelimiter_rejections_total",
+			Help: "Total requests rejected by the rate limiter, labeled by transport.",
+		},
+		[]string{"transport"},
+	)
+
+	dnsQueryDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "smartsni_dns_query_duration_seconds",
+			Help:    "processDNSQuery latency in seconds.",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+
+	sniBackendDuration = prometheus.NewHistogram(
+		prometheus.HistogramOpts{
+			Name:    "smartsni_sni_backend_duration_seconds",
+			Help:    "SNI backend dial+splice duration in seconds.",
+			Buckets: prometheus.DefBuckets,
+		},
+	)
+
+	activeConnections = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "smartsni_active_connections",
+			Help: "Number of handleConnection goroutines currently running.",
+		},
+	)
+)
+
+func init() {
+	prometheus.MustRegister(
+		requestsTotal,
+		sniDispatchTotal,
+		rateLimiterRejectionsTotal,
+		dnsQueryDuration,
+		sniBackendDuration,
+		activeConnections,
+	)
+}
+
+// lastResolveSuccess is the unix time of the last successfully answered
+// query, whether served from the static domain map, the cache, or an
+// upstream resolver; it backs the /healthz endpoint. main seeds it at
+// startup so a freshly started server isn't reported unhealthy before its
+// first query.
+var lastResolveSuccess atomic.Int64
+
+// healthWindow is how recently lastResolveSuccess must have been set for
+// /healthz to report healthy. Configured from Config.HealthWindowSeconds in
+// main, defaulting to defaultHealthWindow.
+var healthWindow = defaultHealthWindow
+
+// startMetricsServer serves /metrics and /healthz on a 127.0.0.1-only
+// listener, kept separate from the public DoH/DoT/SNI listeners.
+func startMetricsServer() {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+	mux.HandleFunc("/healthz", handleHealthz)
+
+	server := &http.Server{
+		Addr:    "127.0.0.1:9090",
+		Handler: mux,
+	}
+	log.Println(server.ListenAndServe())
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	last := lastResolveSuccess.Load()
+	if last == 0 || time.Since(time.Unix(last, 0)) > healthWindow {
+		http.Error(w, "no recent successful resolution", http.StatusServiceUnavailable)
+		return
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"container/list"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+// proxyProtoV2Signature is the fixed 12-byte magic prefixing every PROXY
+// protocol v2 header, per the spec.
+var proxyProtoV2Signature = []byte{0x0D, 0x0A, 0x0D, 0x0A, 0x00, 0x0D, 0x0A, 0x51, 0x55, 0x49, 0x54, 0x0A}
+
+// proxyProtoConn wraps a net.Conn accepted behind an L4 load balancer,
+// overriding RemoteAddr with the original client address carried in a PROXY
+// protocol v1/v2 header.
+type proxyProtoConn struct {
+	net.Conn
+	remoteAddr net.Addr
+}
+
+func (c *proxyProtoConn) RemoteAddr() net.Addr {
+	if c.remoteAddr != nil {
+		return c.remoteAddr
+	}
+	return c.Conn.RemoteAddr()
+}
+
+// bufferedConn reads through a bufio.Reader that may already hold peeked
+// bytes, while delegating every other net.Conn method to the underlying
+// connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) { return c.r.Read(p) }
+
+// closeWriter is implemented by connections that support half-closing the
+// write side, such as *net.TCPConn.
+type closeWriter interface {
+	CloseWrite() error
+}
+
+func (c *bufferedConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+func (c *proxyProtoConn) CloseWrite() error {
+	if cw, ok := c.Conn.(closeWriter); ok {
+		return cw.CloseWrite()
+	}
+	return nil
+}
+
+// closeWrite half-closes the write side of conn when it supports CloseWrite,
+// so connections wrapped by wrapProxyProtocol (or dialed through a non-TCP
+// proxy.Dialer) degrade gracefully instead of panicking on a type assertion.
+func closeWrite(conn net.Conn) {
+	if cw, ok := conn.(closeWriter); ok {
+		cw.CloseWrite()
+	}
+}
+
+// wrapProxyProtocol peeks at the first bytes of conn; if they carry a PROXY
+// protocol v1 or v2 header it consumes the header and returns a conn whose
+// RemoteAddr reports the original client address. Otherwise it returns conn
+// wrapped so that the peeked bytes are still delivered to the next reader.
+func wrapProxyProtocol(conn net.Conn) (net.Conn, error) {
+	br := bufio.NewReader(conn)
+
+	peeked, err := br.Peek(12)
+	if err != nil && err != io.EOF {
+		return nil, fmt.Errorf("proxy protocol: %w", err)
+	}
+
+	var addr net.Addr
+	switch {
+	case len(peeked) >= 12 && bytes.Equal(peeked[:12], proxyProtoV2Signature):
+		addr, err = readProxyProtoV2(br)
+	case len(peeked) >= 6 && string(peeked[:6]) == "PROXY ":
+		addr, err = readProxyProtoV1(br)
+	default:
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return &proxyProtoConn{Conn: &bufferedConn{Conn: conn, r: br}, remoteAddr: addr}, nil
+}
+
+// readProxyProtoV1 parses a textual "PROXY TCP4 src dst srcport dstport\r\n"
+// header, returning the source address. A nil address is returned (with no
+// error) for "PROXY UNKNOWN", in which case the caller should keep using the
+// underlying connection's own RemoteAddr.
+func readProxyProtoV1(br *bufio.Reader) (net.Addr, error) {
+	line, err := br.ReadString('\n')
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol v1: %w", err)
+	}
+
+	fields := strings.Fields(strings.TrimRight(line, "\r\n"))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		return nil, fmt.Errorf("proxy protocol v1: malformed header %q", line)
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil, nil
+	}
+	if len(fields) < 5 {
+		return nil, fmt.Errorf("proxy protocol v1: malformed header %q", line)
+	}
+
+	ip := net.ParseIP(fields[2])
+	if ip == nil {
+		return nil, fmt.Errorf("proxy protocol v1: bad source address %q", fields[2])
+	}
+	port, err := strconv.Atoi(fields[4])
+	if err != nil {
+		return nil, fmt.Errorf("proxy protocol v1: bad source port %q", fields[4])
+	}
+
+	return &net.TCPAddr{IP: ip, Port: port}, nil
+}
+
+// readProxyProtoV2 parses a binary PROXY protocol v2 header (RFC, HAProxy
+// spec), returning the source address. A nil address is returned (with no
+// error) for LOCAL connections (health checks) and unroutable families.
+func readProxyProtoV2(br *bufio.Reader) (net.Addr, error) {
+	header := make([]byte, 16)
+	if _, err := io.ReadFull(br, header); err != nil {
+		return nil, fmt.Errorf("proxy protocol v2: %w", err)
+	}
+
+	verCmd := header[12]
+	if verCmd>>4 != 2 {
+		return nil, fmt.Errorf("proxy protocol v2: unsupported version %d", verCmd>>4)
+	}
+	cmd := verCmd & 0x0F
+
+	family := header[13] >> 4
+	addrLen := binary.BigEndian.Uint16(header[14:16])
+
+	addrBuf := make([]byte, addrLen)
+	if _, err := io.ReadFull(br, addrBuf); err != nil {
+		return nil, fmt.Errorf("proxy protocol v2: %w", err)
+	}
+
+	if cmd == 0x00 { // LOCAL: no address carried
+		return nil, nil
+	}
+
+	switch family {
+	case 0x1: // AF_INET
+		if len(addrBuf) < 12 {
+			return nil, fmt.Errorf("proxy protocol v2: short IPv4 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(addrBuf[0:4]),
+			Port: int(binary.BigEndian.Uint16(addrBuf[8:10])),
+		}, nil
+	case 0x2: // AF_INET6
+		if len(addrBuf) < 36 {
+			return nil, fmt.Errorf("proxy protocol v2: short IPv6 address block")
+		}
+		return &net.TCPAddr{
+			IP:   net.IP(addrBuf[0:16]),
+			Port: int(binary.BigEndian.Uint16(addrBuf[32:34])),
+		}, nil
+	default: // AF_UNSPEC or unix socket: no routable address
+		return nil, nil
+	}
+}
+
+// maxSNILimiters bounds how many per-IP limiters sniLimiterFor keeps at once.
+// Without a bound, an attacker able to reach :443 directly (bypassing the LB)
+// could forge arbitrary PROXY-protocol source IPs and grow the map without
+// limit; the least-recently-used IP is evicted once the bound is hit.
+const maxSNILimiters = 10000
+
+// sniLimiters holds one rate.Limiter per client IP seen on the SNI proxy
+// listener, so a single abusive client can't exhaust the connection budget
+// meant for everyone else behind a shared load balancer.
+var (
+	sniLimitersMu sync.Mutex
+	sniLimitersLL = list.New()
+	sniLimiters   = make(map[string]*list.Element)
+)
+
+// sniLimiterEntry is the value stored in sniLimitersLL.
+type sniLimiterEntry struct {
+	ip      string
+	limiter *rate.Limiter
+}
+
+// sniLimiterFor returns the per-IP rate limiter for ip, creating one on
+// first use with the same rate/burst as the DoH/DoT limiter and evicting the
+// least-recently-used IP if that would grow the table past maxSNILimiters.
+func sniLimiterFor(ip string) *rate.Limiter {
+	sniLimitersMu.Lock()
+	defer sniLimitersMu.Unlock()
+
+	if el, ok := sniLimiters[ip]; ok {
+		sniLimitersLL.MoveToFront(el)
+		return el.Value.(*sniLimiterEntry).limiter
+	}
+
+	entry := &sniLimiterEntry{ip: ip, limiter: rate.NewLimiter(10, 50)}
+	sniLimiters[ip] = sniLimitersLL.PushFront(entry)
+
+	for sniLimitersLL.Len() > maxSNILimiters {
+		oldest := sniLimitersLL.Back()
+		if oldest == nil {
+			break
+		}
+		sniLimitersLL.Remove(oldest)
+		delete(sniLimiters, oldest.Value.(*sniLimiterEntry).ip)
+	}
+
+	return entry.limiter
+}
+
+// clientIPOf extracts the host portion of addr, falling back to its full
+// string form if it isn't a host:port pair.
+func clientIPOf(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
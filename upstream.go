@@ -0,0 +1,429 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// upstreamFailureThreshold is the number of consecutive failures that
+	// pulls an upstream out of rotation.
+	upstreamFailureThreshold = 3
+	// upstreamCooldown is how long a failed upstream is skipped; it rejoins
+	// rotation when this elapses, or earlier if a probe succeeds.
+	upstreamCooldown = 30 * time.Second
+	// upstreamProbeInterval is how often cooled-down upstreams are probed.
+	upstreamProbeInterval = 10 * time.Second
+)
+
+// UpstreamConfig describes one upstream resolver smartSNI can forward
+// unmatched queries to.
+type UpstreamConfig struct {
+	Type string `json:"type"` // "doh", "dot" or "udp"
+	URL  string `json:"url"`  // DoH endpoint, e.g. "https://1.1.1.1/dns-query"
+	Addr string `json:"addr"` // host:port, for "dot" and "udp"
+}
+
+// upstream wraps an UpstreamConfig with the runtime state needed to track its
+// health and reuse connections across queries.
+type upstream struct {
+	cfg UpstreamConfig
+
+	client *http.Client // doh only; reused for HTTP/2 keep-alive
+
+	mu      sync.Mutex
+	dotConn *tls.Conn // dot only; reused to avoid per-query handshakes
+
+	failures      int32
+	cooldownUntil atomic.Int64 // unix nano; zero means not in cooldown
+}
+
+func newUpstream(cfg UpstreamConfig) *upstream {
+	u := &upstream{cfg: cfg}
+	if cfg.Type == "doh" {
+		u.client = &http.Client{
+			Timeout: 5 * time.Second,
+			Transport: &http.Transport{
+				DialContext:       dialContext,
+				ForceAttemptHTTP2: true,
+			},
+		}
+	}
+	return u
+}
+
+func (u *upstream) available() bool {
+	until := u.cooldownUntil.Load()
+	return until == 0 || time.Now().UnixNano() >= until
+}
+
+func (u *upstream) recordSuccess() {
+	atomic.StoreInt32(&u.failures, 0)
+	u.cooldownUntil.Store(0)
+}
+
+func (u *upstream) recordFailure() {
+	if atomic.AddInt32(&u.failures, 1) >= upstreamFailureThreshold {
+		u.cooldownUntil.Store(time.Now().Add(upstreamCooldown).UnixNano())
+	}
+}
+
+// query sends query to this upstream and returns the raw wire-format response.
+func (u *upstream) query(ctx context.Context, query []byte) ([]byte, error) {
+	switch u.cfg.Type {
+	case "doh":
+		return u.queryDoH(ctx, query)
+	case "dot":
+		return u.queryDoT(ctx, query)
+	case "udp":
+		return u.queryUDP(ctx, query)
+	default:
+		return nil, fmt.Errorf("unknown upstream type %q", u.cfg.Type)
+	}
+}
+
+// upstreamQueryTimeout bounds a single dot/udp query when ctx carries no
+// earlier deadline of its own.
+const upstreamQueryTimeout = 5 * time.Second
+
+// armDeadline sets conn's deadline to the earlier of now+timeout and ctx's
+// deadline (if any), and arranges for ctx cancellation to also unblock any
+// pending I/O on conn by forcing an immediate deadline. The returned func
+// must be called once the query is done to stop that watcher goroutine.
+func armDeadline(ctx context.Context, conn net.Conn, timeout time.Duration) func() {
+	deadline := time.Now().Add(timeout)
+	if dl, ok := ctx.Deadline(); ok && dl.Before(deadline) {
+		deadline = dl
+	}
+	conn.SetDeadline(deadline)
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		select {
+		case <-ctx.Done():
+			conn.SetDeadline(time.Now())
+		case <-stop:
+		}
+	}()
+
+	return func() {
+		close(stop)
+		<-done
+	}
+}
+
+func (u *upstream) queryDoH(ctx context.Context, query []byte) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, u.cfg.URL, bytes.NewReader(query))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/dns-message")
+
+	resp, err := u.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	return io.ReadAll(resp.Body)
+}
+
+func (u *upstream) queryDoT(ctx context.Context, query []byte) ([]byte, error) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+
+	conn, err := u.dotConnLocked()
+	if err != nil {
+		return nil, err
+	}
+
+	disarm := armDeadline(ctx, conn, upstreamQueryTimeout)
+	defer disarm()
+
+	if err := writeLengthPrefixed(conn, query); err != nil {
+		u.dotConn = nil
+		return nil, err
+	}
+
+	resp, err := readLengthPrefixed(conn)
+	if err != nil {
+		u.dotConn = nil
+		return nil, err
+	}
+
+	return resp, nil
+}
+
+// dotConnLocked returns the pooled DoT connection, dialing and handshaking a
+// new one if none is established yet. Callers must hold u.mu.
+func (u *upstream) dotConnLocked() (*tls.Conn, error) {
+	if u.dotConn != nil {
+		return u.dotConn, nil
+	}
+
+	rawConn, err := dialUpstream("tcp", u.cfg.Addr, 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, err := net.SplitHostPort(u.cfg.Addr)
+	if err != nil {
+		host = u.cfg.Addr
+	}
+
+	conn := tls.Client(rawConn, &tls.Config{ServerName: host})
+	if err := conn.Handshake(); err != nil {
+		rawConn.Close()
+		return nil, err
+	}
+
+	u.dotConn = conn
+	return conn, nil
+}
+
+func (u *upstream) queryUDP(ctx context.Context, query []byte) ([]byte, error) {
+	conn, err := dialUpstream("udp", u.cfg.Addr, upstreamQueryTimeout)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	disarm := armDeadline(ctx, conn, upstreamQueryTimeout)
+	defer disarm()
+
+	if _, err := conn.Write(query); err != nil {
+		return nil, err
+	}
+
+	buf := make([]byte, 65535)
+	n, err := conn.Read(buf)
+	if err != nil {
+		return nil, err
+	}
+
+	return buf[:n], nil
+}
+
+func writeLengthPrefixed(w io.Writer, msg []byte) error {
+	length := make([]byte, 2)
+	binary.BigEndian.PutUint16(length, uint16(len(msg)))
+	if _, err := w.Write(length); err != nil {
+		return err
+	}
+	_, err := w.Write(msg)
+	return err
+}
+
+func readLengthPrefixed(r io.Reader) ([]byte, error) {
+	length := make([]byte, 2)
+	if _, err := io.ReadFull(r, length); err != nil {
+		return nil, err
+	}
+	buf := make([]byte, binary.BigEndian.Uint16(length))
+	if _, err := io.ReadFull(r, buf); err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+// UpstreamPool resolves queries against a configured set of upstream
+// resolvers using a selection strategy ("first", "random", "round_robin" or
+// "parallel"), skipping upstreams that are in their failure cooldown window.
+type UpstreamPool struct {
+	upstreams []*upstream
+	strategy  string
+	next      uint32 // round_robin cursor
+}
+
+// newUpstreamPool builds an UpstreamPool from cfg. When cfg.Upstreams is
+// empty it falls back to the historical default of Cloudflare's DoH
+// resolver, so existing deployments keep working unconfigured.
+func newUpstreamPool(cfg *Config) *UpstreamPool {
+	configs := cfg.Upstreams
+	if len(configs) == 0 {
+		configs = []UpstreamConfig{{Type: "doh", URL: "https://1.1.1.1/dns-query"}}
+	}
+
+	strategy := cfg.UpstreamStrategy
+	if strategy == "" {
+		strategy = "first"
+	}
+
+	pool := &UpstreamPool{strategy: strategy}
+	for _, c := range configs {
+		pool.upstreams = append(pool.upstreams, newUpstream(c))
+	}
+
+	go pool.probeLoop()
+
+	return pool
+}
+
+// availableUpstreams returns the upstreams currently out of cooldown, or the
+// full set if every upstream is currently down.
+func (p *UpstreamPool) availableUpstreams() []*upstream {
+	var available []*upstream
+	for _, u := range p.upstreams {
+		if u.available() {
+			available = append(available, u)
+		}
+	}
+	if len(available) == 0 {
+		return p.upstreams
+	}
+	return available
+}
+
+// Resolve sends query to one or more upstreams according to the configured
+// strategy and returns the first successful raw response.
+func (p *UpstreamPool) Resolve(query []byte) ([]byte, error) {
+	ctx := context.Background()
+	available := p.availableUpstreams()
+	if len(available) == 0 {
+		return nil, fmt.Errorf("no upstream resolvers configured")
+	}
+
+	order := make([]int, len(available))
+	for i := range order {
+		order[i] = i
+	}
+
+	switch p.strategy {
+	case "random":
+		rand.Shuffle(len(order), func(i, j int) { order[i], order[j] = order[j], order[i] })
+	case "round_robin":
+		start := int(atomic.AddUint32(&p.next, 1) - 1)
+		for i := range order {
+			order[i] = (start + i) % len(available)
+		}
+	case "parallel":
+		return p.resolveParallel(ctx, query, available)
+	}
+
+	return p.tryInOrder(ctx, query, available, order)
+}
+
+func (p *UpstreamPool) tryInOrder(ctx context.Context, query []byte, available []*upstream, order []int) ([]byte, error) {
+	var lastErr error
+	for _, i := range order {
+		u := available[i]
+		resp, err := u.query(ctx, query)
+		if err != nil {
+			u.recordFailure()
+			lastErr = err
+			continue
+		}
+		u.recordSuccess()
+		return resp, nil
+	}
+	return nil, lastErr
+}
+
+// upstreamResult is one upstream's outcome from a resolveParallel fan-out.
+type upstreamResult struct {
+	resp     []byte
+	err      error
+	u        *upstream
+	canceled bool // ctx was already canceled when the query returned
+}
+
+// resolveParallel fires query at every available upstream concurrently and
+// returns the first success. ctx cancellation (propagated via armDeadline for
+// dot/udp and via the request context for doh) actually aborts the rest instead of leaving them to run to completion, and
+// every upstream's outcome is recorded even when its result arrives after the
+// caller has already gotten its answer — except a straggler that only failed
+// because we just canceled it, which is not a real failure and must not count
+// against that upstream's health (otherwise every non-winning upstream would
+// be driven into cooldown within a few parallel resolves, defeating the
+// redundancy the "parallel" strategy exists to provide).
+func (p *UpstreamPool) resolveParallel(ctx context.Context, query []byte, available []*upstream) ([]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+
+	results := make(chan upstreamResult, len(available))
+
+	for _, u := range available {
+		u := u
+		go func() {
+			resp, err := u.query(ctx, query)
+			results <- upstreamResult{resp, err, u, ctx.Err() != nil}
+		}()
+	}
+
+	var lastErr error
+	for i := 0; i < len(available); i++ {
+		r := <-results
+		if r.err != nil {
+			if !r.canceled {
+				r.u.recordFailure()
+				lastErr = r.err
+			}
+			continue
+		}
+		r.u.recordSuccess()
+		cancel()
+		drainUpstreamResults(results, len(available)-i-1)
+		return r.resp, nil
+	}
+	cancel()
+	return nil, lastErr
+}
+
+// drainUpstreamResults consumes the remaining pending results from a
+// resolveParallel fan-out in the background, recording each upstream's
+// success/failure so health tracking stays accurate for queries whose winner
+// has already been returned to the caller. The fan-out's ctx is already
+// canceled by the time this runs, so a straggler's failure only counts
+// against it if its query returned before that cancellation.
+func drainUpstreamResults(results <-chan upstreamResult, remaining int) {
+	go func() {
+		for i := 0; i < remaining; i++ {
+			r := <-results
+			if r.err != nil {
+				if !r.canceled {
+					r.u.recordFailure()
+				}
+				continue
+			}
+			r.u.recordSuccess()
+		}
+	}()
+}
+
+// probeLoop periodically issues a lightweight ". IN NS" query against every
+// cooled-down upstream so it can rejoin rotation as soon as it recovers.
+func (p *UpstreamPool) probeLoop() {
+	probe := new(dns.Msg)
+	probe.SetQuestion(".", dns.TypeNS)
+	probeBytes, err := probe.Pack()
+	if err != nil {
+		log.Println(err)
+		return
+	}
+
+	for range time.Tick(upstreamProbeInterval) {
+		for _, u := range p.upstreams {
+			if u.available() {
+				continue
+			}
+			if _, err := u.query(context.Background(), probeBytes); err != nil {
+				continue
+			}
+			u.recordSuccess()
+		}
+	}
+}